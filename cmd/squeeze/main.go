@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/micahyoung-free/squeezetgz/internal/squeeze"
+)
+
+// splitList splits a comma-separated flag value into its entries,
+// returning nil for an empty string so an unset flag leaves the
+// corresponding Options slice nil.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func main() {
+	// Define command line flags
+	bruteMode := flag.Bool("brute", false, "Use brute-force mode")
+	_ = flag.Bool("window", true, "Use compression-window optimizing mode (default)")
+	codecFlag := flag.String("codec", "gzip", "Output codec: gzip or zstd")
+	chunked := flag.Bool("chunked", false, "Write a seekable, eStargz/zstd:chunked-style output")
+	jobs := flag.Int("jobs", 0, "Worker goroutines for cost-matrix/brute-force search (0 = GOMAXPROCS)")
+	prioritize := flag.String("prioritize", "", "Comma-separated archive paths to bias toward the front")
+	pinPrefix := flag.String("pin-prefix", "", "Comma-separated archive paths locked, in order, to the start of the output")
+	pinSuffix := flag.String("pin-suffix", "", "Comma-separated archive paths locked, in order, to the end of the output")
+	inMemoryThreshold := flag.Int64("in-memory-threshold", 0, "Largest entry size (bytes) kept resident in memory; larger entries spill to disk (0 = use the default)")
+	extract := flag.String("extract", "", "Entry name to pull out of the chunked archive given as the only argument, written to stdout; every other flag is ignored")
+
+	// Parse flags
+	flag.Parse()
+
+	if *extract != "" {
+		if flag.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s -extract <name> <chunked-archive>\n", os.Args[0])
+			os.Exit(1)
+		}
+		if err := squeeze.ExtractFile(flag.Arg(0), *extract, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Check if we have enough arguments
+	if flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <input.tar.gz|input.tar.zst> <output>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// Get input and output file paths
+	inputFile := flag.Arg(0)
+	outputFile := flag.Arg(1)
+
+	// Determine the optimization mode
+	var mode squeeze.Mode
+	if *bruteMode {
+		mode = squeeze.ModeBrute
+	} else {
+		mode = squeeze.ModeWindow
+	}
+
+	var codec squeeze.Codec
+	switch *codecFlag {
+	case "gzip":
+		codec = squeeze.CodecGzip
+	case "zstd":
+		codec = squeeze.CodecZstd
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown --codec %q (want gzip or zstd)\n", *codecFlag)
+		os.Exit(1)
+	}
+
+	// Run the optimization
+	opts := squeeze.Options{
+		Codec:             codec,
+		Chunked:           *chunked,
+		Parallelism:       *jobs,
+		PrioritizedFiles:  splitList(*prioritize),
+		PinnedPrefix:      splitList(*pinPrefix),
+		PinnedSuffix:      splitList(*pinSuffix),
+		InMemoryThreshold: *inMemoryThreshold,
+	}
+	stats, err := squeeze.Process(inputFile, outputFile, mode, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Print the results
+	fmt.Printf("Codec: %s\n", stats.Codec)
+	fmt.Printf("Before: %d KB %.2f%%\n", stats.BeforeKB, stats.BeforeRatio)
+	fmt.Printf("After: %d KB %.2f%%\n", stats.AfterKB, stats.AfterRatio)
+}
@@ -0,0 +1,127 @@
+package squeeze
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"testing"
+
+	kgzip "github.com/klauspost/compress/gzip"
+)
+
+// buildTarGz assembles a tar.gz from raw headers so fuzz seeds can cover tar
+// features testutils.CreateTarGz doesn't produce (PAX records, hardlinks,
+// device nodes, GNU-format headers, size-mismatched content). None of the
+// seeds is a TypeGNUSparse entry.
+func buildTarGz(t testing.TB, entries func(tw *tar.Writer), trailingJunk []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz, err := kgzip.NewWriterLevel(&buf, kgzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(gz)
+	entries(tw)
+	tw.Close()
+	gz.Close()
+	buf.Write(trailingJunk)
+	return buf.Bytes()
+}
+
+// FuzzProcess feeds arbitrary bytes to readArchive, the parser through
+// which Process reads its untrusted input archive, and asserts it never panics and
+// never returns Files inconsistent with what was parsed. It exercises
+// readArchive directly rather than the full Process (which also runs
+// orderWindow, writeArchive, and a checksum re-validation pass on every
+// well-formed input) because those later stages are deterministic once
+// readArchive has succeeded and don't need to be re-fuzzed on every
+// input - folding them in was why this target ran at under 1 exec/sec.
+func FuzzProcess(f *testing.F) {
+	// Seeds are kept deliberately tiny. go test -fuzz runs a minimization
+	// pass on every newly "interesting" input before registering it, and
+	// that pass's cost scales with the input's size - a seed built from
+	// testutils.GenerateTestFiles() here once ran to over 256 KiB raw
+	// (tens of KiB even after gzip), which was large enough that the
+	// engine could spend its whole time budget minimizing a single
+	// mutation of it instead of exploring the corpus. Every seed below
+	// stays at most a few dozen bytes of tar content so minimization
+	// stays cheap no matter what the fuzzer mutates it into.
+	f.Add(buildTarGz(f, func(tw *tar.Writer) {
+		tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0600, Size: 3})
+		tw.Write([]byte("aaa"))
+		tw.WriteHeader(&tar.Header{Name: "b.txt", Mode: 0600, Size: 3})
+		tw.Write([]byte("bbb"))
+	}, nil))
+
+	f.Add(buildTarGz(f, func(tw *tar.Writer) {
+		tw.WriteHeader(&tar.Header{Name: "plain.txt", Mode: 0600, Size: 5})
+		tw.Write([]byte("hello"))
+	}, []byte("trailing garbage that is not a valid gzip member")))
+
+	f.Add(buildTarGz(f, func(tw *tar.Writer) {
+		hdr := &tar.Header{
+			Name: "pax.txt",
+			Mode: 0600,
+			Size: 3,
+			PAXRecords: map[string]string{
+				"user.xattr.example": "value",
+			},
+			Format: tar.FormatPAX,
+		}
+		tw.WriteHeader(hdr)
+		tw.Write([]byte("pax"))
+	}, nil))
+
+	f.Add(buildTarGz(f, func(tw *tar.Writer) {
+		tw.WriteHeader(&tar.Header{Name: "target.txt", Mode: 0600, Size: 4})
+		tw.Write([]byte("data"))
+		tw.WriteHeader(&tar.Header{Name: "hard.txt", Mode: 0600, Typeflag: tar.TypeLink, Linkname: "target.txt"})
+	}, nil))
+
+	f.Add(buildTarGz(f, func(tw *tar.Writer) {
+		tw.WriteHeader(&tar.Header{Name: "chr", Mode: 0600, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3})
+		tw.WriteHeader(&tar.Header{Name: "blk", Mode: 0600, Typeflag: tar.TypeBlock, Devmajor: 8, Devminor: 0})
+	}, nil))
+
+	f.Add(buildTarGz(f, func(tw *tar.Writer) {
+		// A GNU-format header for a plain regular file; it has no sparse map.
+		hdr := &tar.Header{
+			Name:   "sparse.bin",
+			Mode:   0600,
+			Size:   8,
+			Format: tar.FormatGNU,
+		}
+		tw.WriteHeader(hdr)
+		tw.Write([]byte("01234567"))
+	}, nil))
+
+	f.Add(buildTarGz(f, func(tw *tar.Writer) {
+		// Declares more content than is actually written, so the tar
+		// writer itself will error - the resulting prefix still exercises
+		// readArchive's handling of a truncated stream.
+		tw.WriteHeader(&tar.Header{Name: "short.txt", Mode: 0600, Size: 100})
+		tw.Write([]byte("too short"))
+	}, nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir := t.TempDir()
+		input := dir + "/in.tar.gz"
+		if err := os.WriteFile(input, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		files, _, err := readArchive(input, gzipCompressor{}, defaultInMemoryThreshold)
+		if err != nil {
+			return
+		}
+		// A clean parse must produce a File per tar header readArchive
+		// walked, each with a content reader that actually opens.
+		for _, fl := range files {
+			rc, err := fl.Open()
+			if err != nil {
+				t.Fatalf("File %q parsed but its content could not be opened: %v", fl.Header.Name, err)
+			}
+			rc.Close()
+		}
+	})
+}
@@ -2,16 +2,25 @@ package squeeze
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 	"sort"
+	"sync"
 
 	kgzip "github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/errgroup"
 )
 
 // Mode selects the optimizing strategy.
@@ -22,41 +31,259 @@ const (
 	ModeBrute
 )
 
+// Codec identifies the compression backend used to read or write an
+// archive. The reorder heuristics stay codec-agnostic; only readArchive,
+// writeArchive and the window-scoring probe need to know which one is in
+// play.
+type Codec int
+
+const (
+	CodecGzip Codec = iota
+	CodecZstd
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecZstd:
+		return "zstd"
+	default:
+		return "gzip"
+	}
+}
+
 const windowSize = 32 * 1024 // 32KB
 
-// File represents a tar entry with data.
+// File represents a tar entry. Its content lives in a backing store -
+// in-memory for small entries, a spilled temp file otherwise - so large
+// archives don't need every entry resident at once. Head and Tail cache
+// just half the output codec's WindowSize() bytes from each end, which is
+// all the cost-matrix precomputation ever needs, so a disk-backed entry is
+// only read back in full once, when it's finally emitted.
 type File struct {
 	Header *tar.Header
-	Data   []byte
 	Sum    [32]byte
+	Size   int64
+	Head   []byte
+	Tail   []byte
+
+	store fileStore
+}
+
+// Open returns a reader over the entry's full content.
+func (f *File) Open() (io.ReadCloser, error) {
+	return f.store.Open()
+}
+
+// fileStore is the backing store for one archive entry's content.
+type fileStore interface {
+	Open() (io.ReadCloser, error)
 }
 
+// memStore keeps an entry's content resident in memory.
+type memStore struct{ data []byte }
+
+func (m memStore) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(m.data)), nil
+}
+
+// diskStore spills an entry's content to a temp file under os.TempDir().
+type diskStore struct{ path string }
+
+func (d diskStore) Open() (io.ReadCloser, error) {
+	return os.Open(d.path)
+}
+
+// defaultInMemoryThreshold is the largest entry size Process keeps resident
+// in memory when Options.InMemoryThreshold isn't set.
+const defaultInMemoryThreshold = 16 * 1024 * 1024
+
 // Stats captures before/after statistics.
 type Stats struct {
 	BeforeKB    int
 	BeforeRatio float64
 	AfterKB     int
 	AfterRatio  float64
+	Codec       string
+}
+
+// Options configures how Process compresses and parallelizes a run.
+type Options struct {
+	Codec   Codec
+	Chunked bool
+	// Parallelism bounds the number of worker goroutines used to build the
+	// pairwise cost matrix and, in ModeBrute, to search permutations. Zero
+	// means runtime.GOMAXPROCS(0).
+	Parallelism int
+
+	// PinnedPrefix and PinnedSuffix name files, by archive path, that must
+	// appear in the given order at the start and end of the output
+	// respectively. The optimizer only ever reorders the files left over
+	// once both are removed.
+	PinnedPrefix []string
+	PinnedSuffix []string
+
+	// PrioritizedFiles is a softer hint than the pinned lists: these files
+	// get a bias toward the front of the free region orderWindow produces,
+	// without being locked to an exact position.
+	PrioritizedFiles []string
+
+	// InMemoryThreshold is the largest entry size kept resident in memory;
+	// larger entries spill to a temp file under os.TempDir(). Zero means
+	// defaultInMemoryThreshold.
+	InMemoryThreshold int64
 }
 
-// Process takes an input tar.gz and writes an optimized tar.gz to output.
-func Process(inPath, outPath string, mode Mode) (*Stats, error) {
-	files, before, err := readArchive(inPath)
+func (o Options) parallelism() int {
+	if o.Parallelism > 0 {
+		return o.Parallelism
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+func (o Options) inMemoryThreshold() int64 {
+	if o.InMemoryThreshold > 0 {
+		return o.InMemoryThreshold
+	}
+	return defaultInMemoryThreshold
+}
+
+// Compressor abstracts the codec used to read and write archive streams, so
+// that Process and the order* heuristics don't have to hard-code gzip.
+type Compressor interface {
+	Codec() Codec
+	// WindowSize is the span of bytes the codec's back-reference window
+	// covers; orderWindow sizes its probe slices off of it.
+	WindowSize() int
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+func compressorFor(codec Codec) Compressor {
+	if codec == CodecZstd {
+		return zstdCompressor{}
+	}
+	return gzipCompressor{}
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Codec() Codec    { return CodecGzip }
+func (gzipCompressor) WindowSize() int { return windowSize }
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return kgzip.NewWriterLevel(w, gzip.BestCompression)
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return kgzip.NewReader(r)
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Codec() Codec { return CodecZstd }
+
+// WindowSize reports zstd's default window log (8MB) rather than gzip's
+// fixed 32KB, since the scoring probe should reflect how far back the
+// chosen codec can actually find matches.
+func (zstdCompressor) WindowSize() int { return 8 * 1024 * 1024 }
+
+func (zstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+}
+
+func (zstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
+	return zstdReadCloser{dec}, nil
+}
+
+// zstdReadCloser adapts *zstd.Decoder, whose Close method returns nothing,
+// to io.ReadCloser.
+type zstdReadCloser struct{ *zstd.Decoder }
 
-	var order []int
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectCodec sniffs the leading bytes of r to determine which codec
+// produced the archive, so readArchive can accept .tar.gz and .tar.zst
+// input without the caller having to say which is which.
+func detectCodec(r *bufio.Reader) (Compressor, error) {
+	magic, err := r.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return zstdCompressor{}, nil
+	case len(magic) >= 2 && bytes.HasPrefix(magic, gzipMagic):
+		return gzipCompressor{}, nil
+	default:
+		return nil, errors.New("squeeze: unrecognized archive codec")
+	}
+}
+
+// Process takes an input archive and writes an optimized one to output. The
+// input codec is auto-detected from its magic bytes; opts.Codec selects the
+// codec for the output archive. When opts.Chunked is true, the output is
+// written as a sequence of independently-compressed per-entry members
+// followed by a JSON TOC, eStargz/zstd:chunked style, instead of one
+// monolithic stream.
+func Process(inPath, outPath string, mode Mode, opts Options) (*Stats, error) {
+	out := compressorFor(opts.Codec)
+
+	files, before, err := readArchive(inPath, out, opts.inMemoryThreshold())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupSpilled(files)
+
+	prefix, freeIdx, suffix, err := resolveConstraints(files, opts)
+	if err != nil {
+		return nil, err
+	}
+	free := make([]*File, len(freeIdx))
+	for i, idx := range freeIdx {
+		free[i] = files[idx]
+	}
+
+	var freeOrder []int
 	switch mode {
 	case ModeWindow:
-		order = orderWindow(files)
+		freeOrder, err = orderWindow(free, out, opts)
 	case ModeBrute:
-		order = orderBrute(files)
+		freeOrder, err = orderBrute(free, out, opts)
 	default:
 		return nil, errors.New("unknown mode")
 	}
+	if err != nil {
+		return nil, err
+	}
 
-	if err := writeArchive(outPath, files, order); err != nil {
+	order := make([]int, 0, len(files))
+	order = append(order, prefix...)
+	for _, fi := range freeOrder {
+		order = append(order, freeIdx[fi])
+	}
+	order = append(order, suffix...)
+
+	if opts.Chunked {
+		err = writeChunkedArchive(outPath, files, order, out)
+		if err == nil {
+			err = validateChunked(outPath, files, order, out)
+		}
+	} else {
+		err = writeArchive(outPath, files, order, out)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -69,10 +296,21 @@ func Process(inPath, outPath string, mode Mode) (*Stats, error) {
 	ratioBefore := float64(before) / float64(totalSize(files)) * 100
 	ratioAfter := float64(afterInfo.Size()) / float64(totalSize(files)) * 100
 
-	return &Stats{BeforeKB: int(before / 1024), BeforeRatio: ratioBefore, AfterKB: afterKB, AfterRatio: ratioAfter}, nil
+	return &Stats{
+		BeforeKB:    int(before / 1024),
+		BeforeRatio: ratioBefore,
+		AfterKB:     afterKB,
+		AfterRatio:  ratioAfter,
+		Codec:       out.Codec().String(),
+	}, nil
 }
 
-func readArchive(path string) ([]*File, int64, error) {
+// readArchive reads every entry of the archive at path exactly once,
+// spilling entries bigger than threshold to a temp file instead of holding
+// them in memory. The input codec is detected from the archive's magic
+// bytes; c only sets the window size of the head/tail caches readArchive
+// keeps for each entry for the cost matrix.
+func readArchive(path string, c Compressor, threshold int64) ([]*File, int64, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, 0, err
@@ -81,12 +319,19 @@ func readArchive(path string) ([]*File, int64, error) {
 
 	info, _ := f.Stat()
 
-	gz, err := kgzip.NewReader(f)
+	br := bufio.NewReader(f)
+	in, err := detectCodec(br)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	gz, err := in.NewReader(br)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer gz.Close()
 
+	half := c.WindowSize() / 2
 	tr := tar.NewReader(gz)
 	var files []*File
 	for {
@@ -97,25 +342,133 @@ func readArchive(path string) ([]*File, int64, error) {
 		if err != nil {
 			return nil, 0, err
 		}
-		data := make([]byte, hdr.Size)
-		if _, err := io.ReadFull(tr, data); err != nil {
+		file, err := readEntry(hdr, tr, half, threshold)
+		if err != nil {
 			return nil, 0, err
 		}
-		sum := sha256.Sum256(appendHeaderData(hdr, data))
-		files = append(files, &File{Header: hdr, Data: data, Sum: sum})
+		files = append(files, file)
 	}
 
 	return files, info.Size(), nil
 }
 
-func writeArchive(path string, files []*File, order []int) error {
+// maxEntrySize bounds hdr.Size before readEntry trusts it, so a crafted or
+// corrupt header (negative, or absurdly large relative to anything a real
+// archive would contain) is rejected up front instead of driving an
+// oversized allocation or an unbounded read loop.
+const maxEntrySize = 1 << 40 // 1TiB
+
+// readEntry consumes one tar entry's content exactly once: small entries
+// are buffered in memory, larger ones are streamed straight to a temp file.
+// Either way it captures the entry's checksum and its head/tail windows
+// along the way, so nothing needs to re-read a spilled entry until it's
+// finally emitted.
+func readEntry(hdr *tar.Header, r io.Reader, half int, threshold int64) (*File, error) {
+	if hdr.Size < 0 || hdr.Size > maxEntrySize {
+		return nil, fmt.Errorf("squeeze: entry %q has implausible size %d", hdr.Name, hdr.Size)
+	}
+
+	// hdrCopy is a full struct copy, not just the fields squeeze happens to
+	// use, so PAX records, long-name extensions and the header's Format all
+	// travel through to writeArchive unchanged.
+	hdrCopy := *hdr
+	file := &File{Header: &hdrCopy, Size: hdr.Size}
+
+	if hdr.Size <= threshold {
+		data := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		file.store = memStore{data: data}
+		file.Head = headBytes(data, half)
+		file.Tail = tailBytes(data, half)
+		file.Sum = sha256.Sum256(appendHeaderData(hdr, data))
+		return file, nil
+	}
+
+	tmp, err := os.CreateTemp("", "squeeze-entry-*")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	h := sha256.New()
+	hw := tar.NewWriter(h)
+	if err := hw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+
+	var head, tail []byte
+	buf := make([]byte, 1<<20)
+	remaining := hdr.Size
+	for remaining > 0 {
+		n := int64(len(buf))
+		if n > remaining {
+			n = remaining
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return nil, err
+		}
+		chunk := buf[:n]
+		if len(head) < half {
+			need := half - len(head)
+			if need > len(chunk) {
+				need = len(chunk)
+			}
+			head = append(head, chunk[:need]...)
+		}
+		tail = captureTail(tail, chunk, half)
+		if _, err := tmp.Write(chunk); err != nil {
+			return nil, err
+		}
+		if _, err := hw.Write(chunk); err != nil {
+			return nil, err
+		}
+		remaining -= n
+	}
+	if err := hw.Close(); err != nil {
+		return nil, err
+	}
+
+	file.store = diskStore{path: tmp.Name()}
+	file.Head = head
+	file.Tail = tail
+	copy(file.Sum[:], h.Sum(nil))
+	return file, nil
+}
+
+// captureTail returns the trailing half bytes of tailBuf+chunk, copied so
+// the result doesn't alias the caller's reusable read buffer.
+func captureTail(tailBuf, chunk []byte, half int) []byte {
+	if len(chunk) >= half {
+		out := make([]byte, half)
+		copy(out, chunk[len(chunk)-half:])
+		return out
+	}
+	combined := append(append([]byte(nil), tailBuf...), chunk...)
+	if len(combined) > half {
+		combined = combined[len(combined)-half:]
+	}
+	return combined
+}
+
+// cleanupSpilled removes any temp files readArchive spilled entries to.
+func cleanupSpilled(files []*File) {
+	for _, f := range files {
+		if d, ok := f.store.(diskStore); ok {
+			os.Remove(d.path)
+		}
+	}
+}
+
+func writeArchive(path string, files []*File, order []int, c Compressor) error {
 	out, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	gz, err := kgzip.NewWriterLevel(out, gzip.BestCompression)
+	gz, err := c.NewWriter(out)
 	if err != nil {
 		return err
 	}
@@ -129,7 +482,13 @@ func writeArchive(path string, files []*File, order []int) error {
 		if err := tw.WriteHeader(f.Header); err != nil {
 			return err
 		}
-		if _, err := tw.Write(f.Data); err != nil {
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, r)
+		r.Close()
+		if err != nil {
 			return err
 		}
 	}
@@ -143,21 +502,340 @@ func writeArchive(path string, files []*File, order []int) error {
 	}
 
 	// validate checksums
-	if err := validate(path, files, order); err != nil {
+	if err := validate(path, files, order, c); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func validate(path string, files []*File, order []int) error {
+// ChunkTOCEntry records where one archive entry's compressed bytes live in
+// a chunked output, so a consumer can HTTP-range-fetch a single file without
+// decompressing the whole archive.
+type ChunkTOCEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// chunkSize is the largest span of one entry's content written as a single
+// compressed member before it gets split into multiple chunks; it matches
+// eStargz's default chunk size.
+const chunkSize = 4 * 1024 * 1024
+
+// chunkTOCEntryName is the tar entry name the TOC itself is written under,
+// inside its own compressed member.
+const chunkTOCEntryName = "squeeze.index.json"
+
+// chunkedFooterSize is the fixed trailing footer: an 8-byte big-endian
+// offset pointing at the start of the TOC member.
+const chunkedFooterSize = 8
+
+// writeChunkedArchive writes files in order as a sequence of independently
+// compressed members - one per entry, or one per chunkSize slice of large
+// entries - followed by a TOC member and a fixed-size footer pointing at
+// it. Every member shares one tar.Writer, so the decompressed bytes still
+// form a single continuous tar stream for a legacy reader; only the
+// destination it writes to is swapped per member, keeping each member
+// independently decodable.
+func writeChunkedArchive(path string, files []*File, order []int, c Compressor) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cw := &countingWriter{w: out}
+	var toc []ChunkTOCEntry
+
+	sw := &memberSwitchWriter{}
+	tw := tar.NewWriter(sw)
+
+	writeMember := func(name string, hdr *tar.Header, r io.Reader) error {
+		offset := cw.n
+		wc, err := c.NewWriter(cw)
+		if err != nil {
+			return err
+		}
+		sw.cur = wc
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(tw, io.TeeReader(r, h)); err != nil {
+			return err
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if err := wc.Close(); err != nil {
+			return err
+		}
+		toc = append(toc, ChunkTOCEntry{
+			Name:   name,
+			Offset: offset,
+			Size:   cw.n - offset,
+			Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		})
+		return nil
+	}
+
+	for _, idx := range order {
+		f := files[idx]
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if f.Header.Typeflag != tar.TypeReg || f.Size <= chunkSize {
+			err = writeMember(f.Header.Name, f.Header, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for off := int64(0); off < f.Size; off += chunkSize {
+			end := off + chunkSize
+			if end > f.Size {
+				end = f.Size
+			}
+			hdr := *f.Header
+			hdr.Size = end - off
+			name := fmt.Sprintf("%s[%d:%d]", f.Header.Name, off, end)
+			if err := writeMember(name, &hdr, io.LimitReader(rc, end-off)); err != nil {
+				rc.Close()
+				return err
+			}
+		}
+		rc.Close()
+	}
+
+	tocBytes, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+	tocOffset := cw.n
+	if err := writeMember(chunkTOCEntryName, &tar.Header{
+		Name:     chunkTOCEntryName,
+		Mode:     0644,
+		Size:     int64(len(tocBytes)),
+		Typeflag: tar.TypeReg,
+	}, bytes.NewReader(tocBytes)); err != nil {
+		return err
+	}
+	if err := closeTarTrailer(cw, sw, tw, c); err != nil {
+		return err
+	}
+
+	footer := make([]byte, chunkedFooterSize)
+	binary.BigEndian.PutUint64(footer, uint64(tocOffset))
+	_, err = cw.Write(footer)
+	return err
+}
+
+// memberSwitchWriter lets a single long-lived tar.Writer span many
+// independently-compressed members: Write always goes to whichever
+// underlying writer cur currently points at, so the caller can swap in a
+// fresh compressor writer at each member boundary without handing the
+// tar.Writer a new one directly (which would reset its own state).
+type memberSwitchWriter struct {
+	cur io.Writer
+}
+
+func (m *memberSwitchWriter) Write(p []byte) (int, error) {
+	return m.cur.Write(p)
+}
+
+// closeTarTrailer closes tw, emitting the standard tar end-of-archive
+// trailer, into a fresh compressed member of its own so the trailer
+// doesn't get appended after a member that's already been closed.
+func closeTarTrailer(cw *countingWriter, sw *memberSwitchWriter, tw *tar.Writer, c Compressor) error {
+	wc, err := c.NewWriter(cw)
+	if err != nil {
+		return err
+	}
+	sw.cur = wc
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+// readChunkedTOC reads the TOC member at tocOffset, following the same
+// tar+compressor framing writeChunkedArchive wrote it with.
+func readChunkedTOC(f *os.File, tocOffset int64, c Compressor) ([]ChunkTOCEntry, error) {
+	if _, err := f.Seek(tocOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	gz, err := c.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("squeeze: failed to read TOC entry: %w", err)
+	}
+	if hdr.Name != chunkTOCEntryName {
+		return nil, fmt.Errorf("squeeze: expected TOC entry %q, got %q", chunkTOCEntryName, hdr.Name)
+	}
+	var toc []ChunkTOCEntry
+	if err := json.NewDecoder(tr).Decode(&toc); err != nil {
+		return nil, fmt.Errorf("squeeze: failed to decode TOC: %w", err)
+	}
+	return toc, nil
+}
+
+// validateChunked re-reads a chunked archive written by writeChunkedArchive
+// and confirms that the TOC digest of every whole-entry regular-file
+// member matches the content squeeze actually wrote for it, the same
+// integrity check writeArchive gets via validate. Members of split
+// entries, non-regular entries and the TOC itself are not checked.
+func validateChunked(path string, files []*File, order []int, c Compressor) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	gz, err := kgzip.NewReader(f)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < chunkedFooterSize {
+		return errors.New("squeeze: chunked archive too small to contain a footer")
+	}
+	footer := make([]byte, chunkedFooterSize)
+	if _, err := f.ReadAt(footer, info.Size()-chunkedFooterSize); err != nil {
+		return err
+	}
+	tocOffset := int64(binary.BigEndian.Uint64(footer))
+
+	toc, err := readChunkedTOC(f, tocOffset, c)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string][]byte, len(order))
+	for _, idx := range order {
+		fl := files[idx]
+		if fl.Header.Typeflag != tar.TypeReg {
+			continue
+		}
+		rc, err := fl.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(data)
+		byName[fl.Header.Name] = h[:]
+	}
+
+	for _, e := range toc {
+		// Entries split across multiple chunks are named "name[off:end]" and
+		// only cover part of the file's content, so there's no single
+		// whole-file digest to compare a chunk against; only whole-entry
+		// members get checked here.
+		want, ok := byName[e.Name]
+		if !ok {
+			continue
+		}
+		if got := "sha256:" + hex.EncodeToString(want); e.Digest != got {
+			return fmt.Errorf("squeeze: checksum mismatch for chunked entry %q", e.Name)
+		}
+	}
+	return nil
+}
+
+// ExtractFile reads a single entry's content out of a chunked archive at
+// archivePath, using its trailing footer and TOC to seek straight to that
+// entry's independently-compressed member rather than decompressing the
+// whole file. For an entry that was split into multiple chunks at write
+// time, name must match one chunk's "name[start:end]" TOC row exactly;
+// ExtractFile does not reassemble split entries.
+func ExtractFile(archivePath, name string, w io.Writer) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("squeeze: failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < chunkedFooterSize {
+		return errors.New("squeeze: archive too small to contain a chunked footer")
+	}
+
+	footer := make([]byte, chunkedFooterSize)
+	if _, err := f.ReadAt(footer, info.Size()-chunkedFooterSize); err != nil {
+		return err
+	}
+	tocOffset := int64(binary.BigEndian.Uint64(footer))
+
+	br := bufio.NewReader(f)
+	c, err := detectCodec(br)
+	if err != nil {
+		return fmt.Errorf("squeeze: failed to detect archive codec: %w", err)
+	}
+
+	toc, err := readChunkedTOC(f, tocOffset, c)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range toc {
+		if e.Name != name {
+			continue
+		}
+		if _, err := f.Seek(e.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		member := io.LimitReader(f, e.Size)
+		mgz, err := c.NewReader(bufio.NewReader(member))
+		if err != nil {
+			return err
+		}
+		defer mgz.Close()
+		mtr := tar.NewReader(mgz)
+		if _, err := mtr.Next(); err != nil {
+			return fmt.Errorf("squeeze: failed to read member entry: %w", err)
+		}
+		_, err = io.Copy(w, mtr)
+		return err
+	}
+	return fmt.Errorf("squeeze: entry %q not found in archive TOC", name)
+}
+
+// countingWriter tracks the number of bytes written so far, so
+// writeChunkedArchive can record each member's starting offset for the TOC.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func validate(path string, files []*File, order []int, c Compressor) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := c.NewReader(f)
 	if err != nil {
 		return err
 	}
@@ -173,11 +851,19 @@ func validate(path string, files []*File, order []int) error {
 		if err != nil {
 			return err
 		}
-		data := make([]byte, hdr.Size)
-		if _, err := io.ReadFull(tr, data); err != nil {
+		h := sha256.New()
+		hw := tar.NewWriter(h)
+		if err := hw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(hw, tr); err != nil {
+			return err
+		}
+		if err := hw.Close(); err != nil {
 			return err
 		}
-		sum := sha256.Sum256(appendHeaderData(hdr, data))
+		var sum [32]byte
+		copy(sum[:], h.Sum(nil))
 		if sum != files[order[i]].Sum {
 			return fmt.Errorf("checksum mismatch for %s", hdr.Name)
 		}
@@ -198,99 +884,470 @@ func appendHeaderData(h *tar.Header, d []byte) []byte {
 func totalSize(files []*File) int64 {
 	var n int64
 	for _, f := range files {
-		n += int64(len(f.Data))
+		n += f.Size
 	}
 	return n
 }
 
-// orderWindow implements the compression window optimizing mode.
-func orderWindow(files []*File) []int {
+// resolveConstraints splits files into a fixed prefix, a fixed suffix, and
+// the "free" files left for the optimizer to permute, based on
+// opts.PinnedPrefix/opts.PinnedSuffix. Prefix and suffix entries are
+// returned in the exact order given; free keeps the original archive order
+// and is what orderWindow/orderBrute actually get to rearrange.
+func resolveConstraints(files []*File, opts Options) (prefix, free, suffix []int, err error) {
+	byName := make(map[string]int, len(files))
+	for i, f := range files {
+		byName[f.Header.Name] = i
+	}
+	pinned := make(map[int]bool)
+
+	resolve := func(names []string) ([]int, error) {
+		idxs := make([]int, 0, len(names))
+		for _, name := range names {
+			i, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("squeeze: pinned file %q not found in archive", name)
+			}
+			if pinned[i] {
+				return nil, fmt.Errorf("squeeze: file %q pinned more than once", name)
+			}
+			pinned[i] = true
+			idxs = append(idxs, i)
+		}
+		return idxs, nil
+	}
+
+	if prefix, err = resolve(opts.PinnedPrefix); err != nil {
+		return nil, nil, nil, err
+	}
+	if suffix, err = resolve(opts.PinnedSuffix); err != nil {
+		return nil, nil, nil, err
+	}
+	for i := range files {
+		if !pinned[i] {
+			free = append(free, i)
+		}
+	}
+	return prefix, free, suffix, nil
+}
+
+// priorityBiasScore is subtracted from a prioritized file's window score -
+// large enough to consistently outweigh ordinary compression-cost
+// differences and pull the file toward the front, but it's still only a
+// bias: unlike PinnedPrefix it can be outvoted by an even stronger match.
+const priorityBiasScore = 1 << 16
+
+// priorityBias returns a per-file score adjustment reflecting
+// opts.PrioritizedFiles, for use while walking the cost matrix in
+// orderWindow.
+func priorityBias(files []*File, opts Options) []int {
+	bias := make([]int, len(files))
+	if len(opts.PrioritizedFiles) == 0 {
+		return bias
+	}
+	prioritized := make(map[string]bool, len(opts.PrioritizedFiles))
+	for _, name := range opts.PrioritizedFiles {
+		prioritized[name] = true
+	}
+	for i, f := range files {
+		if prioritized[f.Header.Name] {
+			bias[i] = -priorityBiasScore
+		}
+	}
+	return bias
+}
+
+// probeSize reports the size of b after compressing it with c, used to
+// score candidate orderings without writing a whole archive.
+func probeSize(b []byte, c Compressor) int {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return len(b)
+	}
+	w.Write(b)
+	w.Close()
+	return buf.Len()
+}
+
+// selfCompressibility approximates how well a file compresses on its own,
+// using just its cached head and tail windows instead of its full content -
+// which, for a disk-backed entry, may no longer be resident in memory.
+func selfCompressibility(f *File, c Compressor) int {
+	return probeSize(f.Head, c) + probeSize(f.Tail, c)
+}
+
+func headBytes(b []byte, half int) []byte {
+	if len(b) <= half {
+		return b
+	}
+	return b[:half]
+}
+
+func tailBytes(b []byte, half int) []byte {
+	if len(b) <= half {
+		return b
+	}
+	return b[len(b)-half:]
+}
+
+// buildCostMatrix computes cost[i][j], the compressed size of file i's tail
+// window followed by file j's head window, for every ordered pair of
+// distinct files. This is the single O(n^2) step that orderWindow and
+// orderBrute both build on, instead of each repeating pairwise probes (or,
+// for orderBrute, a full archive re-encode) on demand for every candidate.
+func buildCostMatrix(ctx context.Context, files []*File, c Compressor, parallelism int) ([][]int, error) {
 	n := len(files)
-	remaining := make(map[int]bool)
+	heads := make([][]byte, n)
+	tails := make([][]byte, n)
+	for i, f := range files {
+		heads[i] = f.Head
+		tails[i] = f.Tail
+	}
+
+	cost := make([][]int, n)
+	for i := range cost {
+		cost[i] = make([]int, n)
+	}
+
+	bufPool := sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+	g, _ := errgroup.WithContext(ctx)
+	g.SetLimit(parallelism)
 	for i := 0; i < n; i++ {
-		remaining[i] = true
+		i := i
+		for j := 0; j < n; j++ {
+			j := j
+			if i == j {
+				continue
+			}
+			g.Go(func() error {
+				buf := bufPool.Get().(*bytes.Buffer)
+				buf.Reset()
+				defer bufPool.Put(buf)
+
+				w, err := c.NewWriter(buf)
+				if err != nil {
+					return err
+				}
+				if _, err := w.Write(tails[i]); err != nil {
+					return err
+				}
+				if _, err := w.Write(heads[j]); err != nil {
+					return err
+				}
+				if err := w.Close(); err != nil {
+					return err
+				}
+				cost[i][j] = buf.Len()
+				return nil
+			})
+		}
 	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return cost, nil
+}
+
+// tourCost sums the pairwise cost of consecutive entries in order.
+func tourCost(cost [][]int, order []int) int {
+	total := 0
+	for i := 1; i < len(order); i++ {
+		total += cost[order[i-1]][order[i]]
+	}
+	return total
+}
+
+// twoOpt refines a tour with a standard path 2-opt local search: for every
+// pair of positions i<j, try reversing the segment between them and keep
+// the reversal whenever it lowers the sum of the (at most four) edges it
+// touches. Repeats until a full pass makes no improvement.
+func twoOpt(order []int, cost [][]int) []int {
+	n := len(order)
+	improved := true
+	for improved {
+		improved = false
+		for i := 0; i < n-1; i++ {
+			for j := i + 1; j < n; j++ {
+				before, after := 0, 0
+				if i > 0 {
+					before += cost[order[i-1]][order[i]]
+					after += cost[order[i-1]][order[j]]
+				}
+				if j < n-1 {
+					before += cost[order[j]][order[j+1]]
+					after += cost[order[i]][order[j+1]]
+				}
+				if after < before {
+					for l, r := i, j; l < r; l, r = l+1, r-1 {
+						order[l], order[r] = order[r], order[l]
+					}
+					improved = true
+				}
+			}
+		}
+	}
+	return order
+}
 
-	var order []int
-	// pick file with best compression on last window/2 bytes
-	best := -1
-	bestScore := 1<<31 - 1
+// orderWindow builds the pairwise cost matrix in parallel, walks it with a
+// greedy nearest-neighbor heuristic to produce an initial tour, and then
+// polishes that tour with 2-opt.
+func orderWindow(files []*File, c Compressor, opts Options) ([]int, error) {
+	n := len(files)
+	if n == 0 {
+		return nil, nil
+	}
+
+	cost, err := buildCostMatrix(context.Background(), files, c, opts.parallelism())
+	if err != nil {
+		return nil, err
+	}
+	bias := priorityBias(files, opts)
+
+	// Start from the file that's least compressible on its own; whatever
+	// follows it has the best chance of being the one finding matches.
+	// PrioritizedFiles nudges this choice toward the front too. This only
+	// looks at each file's head/tail windows rather than its full content,
+	// since a disk-backed entry's full content may not be resident.
+	start := 0
+	worst := -1
 	for i, f := range files {
-		start := 0
-		if len(f.Data) > windowSize/2 {
-			start = len(f.Data) - windowSize/2
-		}
-		score := gzipSize(f.Data[start:])
-		if score < bestScore {
-			best = i
-			bestScore = score
-		}
-	}
-	order = append(order, best)
-	delete(remaining, best)
-
-	for len(remaining) > 0 {
-		prev := files[order[len(order)-1]]
-		best = -1
-		bestScore = 1<<31 - 1
-		for i := range remaining {
-			startPrev := 0
-			if len(prev.Data) > windowSize/2 {
-				startPrev = len(prev.Data) - windowSize/2
+		score := selfCompressibility(f, c) - bias[i]
+		if score > worst {
+			worst = score
+			start = i
+		}
+	}
+
+	visited := make([]bool, n)
+	order := make([]int, 0, n)
+	order = append(order, start)
+	visited[start] = true
+	for len(order) < n {
+		cur := order[len(order)-1]
+		next, best := -1, 1<<31-1
+		for j := 0; j < n; j++ {
+			if visited[j] || j == cur {
+				continue
 			}
-			endNext := windowSize / 2
-			if endNext > len(files[i].Data) {
-				endNext = len(files[i].Data)
+			if score := cost[cur][j] + bias[j]; score < best {
+				best, next = score, j
 			}
-			combined := append(prev.Data[startPrev:], files[i].Data[:endNext]...)
-			score := gzipSize(combined)
-			if score < bestScore {
-				best = i
-				bestScore = score
+		}
+		order = append(order, next)
+		visited[next] = true
+	}
+
+	return twoOpt(order, cost), nil
+}
+
+// bruteForceThreshold is the file count above which factorial enumeration
+// stops being practical; orderBrute falls back to an exact Held-Karp DP
+// over the cost matrix, which scales as 2^n * n^2 instead of n!.
+const bruteForceThreshold = 12
+
+// heldKarpMaxFiles is the largest N orderBrute will solve exactly via
+// Held-Karp before falling back to greedy+2-opt: at N=18 the DP's 2^N*N
+// tables are already tens of megabytes, and every file beyond that doubles
+// both tables again, so this is chosen as the practical ceiling rather than
+// a hard correctness limit. Matches heldKarpMaxFiles in squeezetgz.go.
+const heldKarpMaxFiles = 18
+
+// orderBrute finds the overall-best ordering by exact search over the
+// pairwise cost matrix: true permutation enumeration (parallelized across
+// workers, each with its own local best) for up to bruteForceThreshold
+// files, exact Held-Karp dynamic programming up to heldKarpMaxFiles, and
+// greedy nearest-neighbor plus 2-opt beyond that - Held-Karp's 2^n-sized
+// tables make it just as impractical as n! enumeration past a few more
+// files, so there has to be a third tier for large archives.
+func orderBrute(files []*File, c Compressor, opts Options) ([]int, error) {
+	n := len(files)
+	if n == 0 {
+		return nil, nil
+	}
+
+	cost, err := buildCostMatrix(context.Background(), files, c, opts.parallelism())
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case n <= bruteForceThreshold:
+		return bruteForceMatrix(cost, opts.parallelism()), nil
+	case n <= heldKarpMaxFiles:
+		return heldKarp(cost), nil
+	default:
+		return twoOpt(greedyTour(cost), cost), nil
+	}
+}
+
+// greedyTour builds an initial tour by starting from the file with the
+// worst average pairwise cost - the one that's most expensive no matter
+// what it's paired with - then repeatedly walking to the cheapest
+// unvisited file. Used as the construction heuristic for orderBrute's
+// above-heldKarpMaxFiles fallback.
+func greedyTour(cost [][]int) []int {
+	n := len(cost)
+	start := 0
+	worstAvg := -1.0
+	for i := 0; i < n; i++ {
+		total := 0
+		for j := 0; j < n; j++ {
+			if i != j {
+				total += cost[i][j]
 			}
 		}
-		order = append(order, best)
-		delete(remaining, best)
+		avg := float64(total) / float64(n-1)
+		if avg > worstAvg {
+			worstAvg, start = avg, i
+		}
 	}
 
+	visited := make([]bool, n)
+	order := make([]int, 0, n)
+	order = append(order, start)
+	visited[start] = true
+	for len(order) < n {
+		cur := order[len(order)-1]
+		next, best := -1, 1<<31-1
+		for j := 0; j < n; j++ {
+			if visited[j] {
+				continue
+			}
+			if cost[cur][j] < best {
+				best, next = cost[cur][j], j
+			}
+		}
+		order = append(order, next)
+		visited[next] = true
+	}
 	return order
 }
 
-func gzipSize(b []byte) int {
-	var buf bytes.Buffer
-	gz, _ := kgzip.NewWriterLevel(&buf, gzip.BestCompression)
-	gz.Write(b)
-	gz.Close()
-	return buf.Len()
+// bruteForceMatrix enumerates every permutation of the cost matrix's
+// indices, dispatching one worker per choice of first element; each worker
+// permutes the remaining n-1 indices on its own and keeps a local best,
+// with a final reduction picking the cheapest tour across workers.
+func bruteForceMatrix(cost [][]int, parallelism int) []int {
+	n := len(cost)
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+
+	type result struct {
+		order []int
+		score int
+	}
+	results := make(chan result, n)
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for _, first := range idx {
+		first := first
+		wg.Add(1)
+		go func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			defer wg.Done()
+
+			rest := make([]int, 0, n-1)
+			for _, v := range idx {
+				if v != first {
+					rest = append(rest, v)
+				}
+			}
+
+			bestOrder := append([]int{first}, rest...)
+			bestScore := tourCost(cost, bestOrder)
+
+			permute(rest, func(p []int) {
+				order := append([]int{first}, p...)
+				if score := tourCost(cost, order); score < bestScore {
+					bestScore = score
+					bestOrder = append([]int(nil), order...)
+				}
+			})
+
+			results <- result{order: bestOrder, score: bestScore}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	best := result{score: 1<<31 - 1}
+	for r := range results {
+		if r.score < best.score {
+			best = r
+		}
+	}
+	return best.order
 }
 
-// orderBrute tries all permutations and picks best overall compression.
-func orderBrute(files []*File) []int {
-	idxs := make([]int, len(files))
-	for i := range idxs {
-		idxs[i] = i
+// heldKarp computes an exact minimum-cost Hamiltonian path over the cost
+// matrix: dp[S][j] is the cost of the cheapest path that visits exactly the
+// set of files S and ends at file j, with S encoded as a bitmask. This is
+// 2^n * n^2 time and 2^n * n memory, tractable well beyond the point where
+// n! enumeration stops being practical (though still only for n up to the
+// low twenties before the bitmask tables themselves become too large).
+func heldKarp(cost [][]int) []int {
+	n := len(cost)
+	full := 1 << n
+	const inf = 1 << 30
+
+	dp := make([][]int, full)
+	parent := make([][]int, full)
+	for s := range dp {
+		dp[s] = make([]int, n)
+		parent[s] = make([]int, n)
+		for j := range dp[s] {
+			dp[s][j] = inf
+			parent[s][j] = -1
+		}
+	}
+	for j := 0; j < n; j++ {
+		dp[1<<j][j] = 0
 	}
-	best := make([]int, len(files))
-	bestScore := 1<<31 - 1
 
-	permute(idxs, func(p []int) {
-		var buf bytes.Buffer
-		gz, _ := kgzip.NewWriterLevel(&buf, gzip.BestCompression)
-		tw := tar.NewWriter(gz)
-		for _, idx := range p {
-			f := files[idx]
-			tw.WriteHeader(f.Header)
-			tw.Write(f.Data)
+	for s := 1; s < full; s++ {
+		for j := 0; j < n; j++ {
+			if s&(1<<j) == 0 || dp[s][j] == inf {
+				continue
+			}
+			for k := 0; k < n; k++ {
+				if s&(1<<k) != 0 {
+					continue
+				}
+				ns := s | (1 << k)
+				if nc := dp[s][j] + cost[j][k]; nc < dp[ns][k] {
+					dp[ns][k] = nc
+					parent[ns][k] = j
+				}
+			}
 		}
-		tw.Close()
-		gz.Close()
-		if buf.Len() < bestScore {
-			bestScore = buf.Len()
-			copy(best, p)
+	}
+
+	bestEnd, best := 0, inf
+	for j := 0; j < n; j++ {
+		if dp[full-1][j] < best {
+			best, bestEnd = dp[full-1][j], j
 		}
-	})
+	}
 
-	return best
+	order := make([]int, n)
+	s, j := full-1, bestEnd
+	for i := n - 1; i >= 0; i-- {
+		order[i] = j
+		pj := parent[s][j]
+		s ^= 1 << j
+		j = pj
+	}
+	return order
 }
 
 func permute(a []int, f func([]int)) {
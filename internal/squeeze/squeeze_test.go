@@ -3,6 +3,7 @@ package squeeze
 import (
 	"archive/tar"
 	"bytes"
+	"fmt"
 	"io"
 	"math/rand"
 	"os"
@@ -85,12 +86,12 @@ func TestModesProduceSameArrangement(t *testing.T) {
 	outWindow := dir + "/out_window.tar.gz"
 	outBrute := dir + "/out_brute.tar.gz"
 
-	statsW, err := Process(input, outWindow, ModeWindow)
+	statsW, err := Process(input, outWindow, ModeWindow, Options{Codec: CodecGzip})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	statsB, err := Process(input, outBrute, ModeBrute)
+	statsB, err := Process(input, outBrute, ModeBrute, Options{Codec: CodecGzip})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,6 +139,214 @@ func orderFromArchive(path string) ([]string, error) {
 	return names, nil
 }
 
+// TestLargeArchive exercises the disk-spill path in readArchive: an entry
+// above the (here artificially lowered) in-memory threshold should round
+// trip through a temp file rather than being held fully in memory. The
+// entry is sized past 1 GiB so it actually guards the OOM regression this
+// test was written for, not just the spill codepath in the abstract.
+func TestLargeArchive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large-archive test in short mode")
+	}
+
+	dir := t.TempDir()
+	big := make([]byte, 1<<30+1<<20) // 1 GiB + 1 MiB
+	rand.New(rand.NewSource(7)).Read(big)
+
+	input := dir + "/in.tar.gz"
+	if err := createTarGz(input, map[string][]byte{"big.bin": big, "small.txt": []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	output := dir + "/out.tar.gz"
+	_, err := Process(input, output, ModeWindow, Options{Codec: CodecGzip, InMemoryThreshold: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := orderFromArchive(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 {
+		t.Fatalf("expected 2 files, got %d: %v", len(order), order)
+	}
+
+	leftover, _ := os.ReadDir(os.TempDir())
+	for _, e := range leftover {
+		if bytes.HasPrefix([]byte(e.Name()), []byte("squeeze-entry-")) {
+			t.Errorf("spilled temp file %q was not cleaned up", e.Name())
+		}
+	}
+}
+
+// TestOrderBruteLargeFileCount guards the OOM regression where orderBrute
+// fell through to heldKarp unconditionally above bruteForceThreshold: past
+// heldKarpMaxFiles its 2^n-sized tables are themselves impractical, so
+// orderBrute must fall back to greedy+2-opt instead. 25 files is well
+// past both thresholds; this must return quickly and without exhausting
+// memory.
+func TestOrderBruteLargeFileCount(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string][]byte, 25)
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 25; i++ {
+		data := make([]byte, 64)
+		r.Read(data)
+		files[fmt.Sprintf("f%02d.bin", i)] = data
+	}
+
+	input := dir + "/in.tar.gz"
+	if err := createTarGz(input, files); err != nil {
+		t.Fatal(err)
+	}
+
+	output := dir + "/out.tar.gz"
+	if _, err := Process(input, output, ModeBrute, Options{Codec: CodecGzip}); err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := orderFromArchive(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != len(files) {
+		t.Fatalf("expected %d files in output, got %d: %v", len(files), len(order), order)
+	}
+}
+
+func TestResolveConstraints(t *testing.T) {
+	files := []*File{
+		{Header: &tar.Header{Name: "a.txt"}},
+		{Header: &tar.Header{Name: "b.txt"}},
+		{Header: &tar.Header{Name: "c.txt"}},
+	}
+
+	prefix, free, suffix, err := resolveConstraints(files, Options{
+		PinnedPrefix: []string{"a.txt"},
+		PinnedSuffix: []string{"c.txt"},
+	})
+	if err != nil {
+		t.Fatalf("resolveConstraints: %v", err)
+	}
+	if len(prefix) != 1 || prefix[0] != 0 {
+		t.Fatalf("expected prefix [0], got %v", prefix)
+	}
+	if len(suffix) != 1 || suffix[0] != 2 {
+		t.Fatalf("expected suffix [2], got %v", suffix)
+	}
+	if len(free) != 1 || free[0] != 1 {
+		t.Fatalf("expected free [1], got %v", free)
+	}
+
+	if _, _, _, err := resolveConstraints(files, Options{PinnedPrefix: []string{"missing.txt"}}); err == nil {
+		t.Fatal("expected an error for a pinned file not in the archive")
+	}
+
+	if _, _, _, err := resolveConstraints(files, Options{
+		PinnedPrefix: []string{"a.txt"},
+		PinnedSuffix: []string{"a.txt"},
+	}); err == nil {
+		t.Fatal("expected an error for a file pinned more than once")
+	}
+}
+
+// TestPinnedOrdering confirms PinnedPrefix/PinnedSuffix survive a full
+// Process run and land exactly where pinned, with the optimizer only
+// free to rearrange what's left.
+func TestPinnedOrdering(t *testing.T) {
+	dir := t.TempDir()
+	files := genAlphaFiles(windowSize)
+	for k, v := range genRandomFiles() {
+		files[k] = v
+	}
+
+	input := dir + "/in.tar.gz"
+	if err := createTarGz(input, files); err != nil {
+		t.Fatal(err)
+	}
+
+	output := dir + "/out.tar.gz"
+	_, err := Process(input, output, ModeWindow, Options{
+		Codec:        CodecGzip,
+		PinnedPrefix: []string{"d.txt"},
+		PinnedSuffix: []string{"a.txt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := orderFromArchive(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order[0] != "d.txt" {
+		t.Fatalf("expected d.txt pinned to the front, got order %v", order)
+	}
+	if order[len(order)-1] != "a.txt" {
+		t.Fatalf("expected a.txt pinned to the back, got order %v", order)
+	}
+}
+
+// TestPrioritizedFilesBias confirms PrioritizedFiles pulls a named file
+// toward the front of the optimizer's output relative to an unbiased run.
+func TestPrioritizedFilesBias(t *testing.T) {
+	dir := t.TempDir()
+	files := genAlphaFiles(windowSize)
+	for k, v := range genRandomFiles() {
+		files[k] = v
+	}
+
+	input := dir + "/in.tar.gz"
+	if err := createTarGz(input, files); err != nil {
+		t.Fatal(err)
+	}
+
+	plainOut := dir + "/out_plain.tar.gz"
+	if _, err := Process(input, plainOut, ModeWindow, Options{Codec: CodecGzip}); err != nil {
+		t.Fatal(err)
+	}
+	plainOrder, err := orderFromArchive(plainOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainPos := -1
+	for i, name := range plainOrder {
+		if name == "noise2.bin" {
+			plainPos = i
+		}
+	}
+	if plainPos <= 0 {
+		t.Skip("noise2.bin already at the front without bias; nothing to assert")
+	}
+
+	biasedOut := dir + "/out_biased.tar.gz"
+	if _, err := Process(input, biasedOut, ModeWindow, Options{
+		Codec:            CodecGzip,
+		PrioritizedFiles: []string{"noise2.bin"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	biasedOrder, err := orderFromArchive(biasedOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	biasedPos := -1
+	for i, name := range biasedOrder {
+		if name == "noise2.bin" {
+			biasedPos = i
+		}
+	}
+	if biasedPos < 0 {
+		t.Fatalf("noise2.bin missing from biased output %v", biasedOrder)
+	}
+	if biasedPos >= plainPos {
+		t.Fatalf("expected PrioritizedFiles to move noise2.bin earlier: plain pos %d, biased pos %d", plainPos, biasedPos)
+	}
+}
+
 func TestMain(m *testing.M) {
 	rand.Seed(time.Now().UnixNano())
 	os.Exit(m.Run())
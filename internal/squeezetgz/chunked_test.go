@@ -0,0 +1,217 @@
+package squeezetgz_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/micahyoung-free/squeezetgz/internal/squeezetgz"
+	"github.com/micahyoung-free/squeezetgz/internal/testutils"
+)
+
+// readAllTarEntries decompresses data with the standard library's gzip
+// reader (which transparently walks concatenated members) and a plain
+// tar.Reader, returning every entry's name and, for regular files, its
+// content. This simulates a "legacy reader" that knows nothing about
+// ChunkedMode/eStargz framing - it should still see the whole archive.
+func readAllTarEntries(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to open gzip reader: %v", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	out := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar entry: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			out[hdr.Name] = nil
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read content for %q: %v", hdr.Name, err)
+		}
+		out[hdr.Name] = content
+	}
+	return out
+}
+
+func TestChunkedModeRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+
+	testFiles, err := testutils.GenerateTestFiles()
+	if err != nil {
+		t.Fatalf("Failed to generate test files: %v", err)
+	}
+	tarGzData, err := testutils.CreateTarGz(testFiles)
+	if err != nil {
+		t.Fatalf("Failed to create test tar.gz: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := squeezetgz.OptimizeTarGzStream(bytes.NewReader(tarGzData), &out, squeezetgz.WindowMode, squeezetgz.Options{
+		Output: squeezetgz.ChunkedMode,
+	}); err != nil {
+		t.Fatalf("OptimizeTarGzStream with ChunkedMode failed: %v", err)
+	}
+
+	// A plain gzip+tar reader - the "legacy reader" the package promises
+	// chunked output still works with - must see every original entry,
+	// not just the first one.
+	entries := readAllTarEntries(t, out.Bytes())
+	for name, tf := range testFiles {
+		content, ok := entries[name]
+		if !ok {
+			t.Errorf("entry %q missing from chunked output decompressed as a plain tar.gz", name)
+			continue
+		}
+		if tf.Type == testutils.RegularFile || tf.Type == testutils.EmptyFile {
+			if !bytes.Equal(content, tf.Content) {
+				t.Errorf("entry %q content mismatch after chunked round trip", name)
+			}
+		}
+	}
+	// The TOC entry itself also rides inside the tar stream.
+	if _, ok := entries["squeezetgz.index.json"]; !ok {
+		t.Errorf("TOC entry missing from chunked output's tar stream")
+	}
+
+	// ExtractFile should be able to pull a single entry back out using the
+	// footer+TOC without decompressing the whole archive.
+	archivePath := filepath.Join(tempDir, "chunked.tar.gz")
+	if err := os.WriteFile(archivePath, out.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write chunked archive: %v", err)
+	}
+	var extracted bytes.Buffer
+	if err := squeezetgz.ExtractFile(archivePath, "file1.txt", &extracted); err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	if !bytes.Equal(extracted.Bytes(), testFiles["file1.txt"].Content) {
+		t.Errorf("ExtractFile returned wrong content for file1.txt")
+	}
+}
+
+func TestChunkedModeZstdRoundTrip(t *testing.T) {
+	testFiles, err := testutils.GenerateTestFiles()
+	if err != nil {
+		t.Fatalf("Failed to generate test files: %v", err)
+	}
+	tarGzData, err := testutils.CreateTarGz(testFiles)
+	if err != nil {
+		t.Fatalf("Failed to create test tar.gz: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := squeezetgz.OptimizeTarGzStream(bytes.NewReader(tarGzData), &out, squeezetgz.TSPMode, squeezetgz.Options{
+		Codec:  squeezetgz.CodecZstd,
+		Output: squeezetgz.ChunkedMode,
+	}); err != nil {
+		t.Fatalf("OptimizeTarGzStream with zstd ChunkedMode failed: %v", err)
+	}
+
+	// A plain zstd+tar reader must see every entry too: the zstd:chunked
+	// TOC rides in a skippable frame, which a standards-compliant zstd
+	// decoder skips on its own, leaving a continuous tar stream behind.
+	zr, err := zstd.NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to open zstd reader: %v", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	seen := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar entry from zstd chunked output: %v", err)
+		}
+		seen[hdr.Name] = true
+	}
+	for name := range testFiles {
+		if !seen[name] {
+			t.Errorf("entry %q missing from zstd chunked output decompressed as a plain tar.zst", name)
+		}
+	}
+}
+
+func TestOptimizeToEStargz(t *testing.T) {
+	tempDir := t.TempDir()
+
+	testFiles, err := testutils.GenerateTestFiles()
+	if err != nil {
+		t.Fatalf("Failed to generate test files: %v", err)
+	}
+	tarGzData, err := testutils.CreateTarGz(testFiles)
+	if err != nil {
+		t.Fatalf("Failed to create test tar.gz: %v", err)
+	}
+	inputPath := filepath.Join(tempDir, "input.tar.gz")
+	if err := os.WriteFile(inputPath, tarGzData, 0644); err != nil {
+		t.Fatalf("Failed to write test tar.gz: %v", err)
+	}
+
+	outputPath := filepath.Join(tempDir, "output.stargz")
+	if _, err := squeezetgz.OptimizeToEStargz(inputPath, outputPath, squeezetgz.WindowMode,
+		squeezetgz.WithPrioritizedFiles([]string{"file1.txt"}),
+	); err != nil {
+		t.Fatalf("OptimizeToEStargz failed: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("failed to read eStargz output: %v", err)
+	}
+
+	// A plain gzip+tar reader must still see every original entry plus
+	// the prefetch landmark and TOC.
+	entries := readAllTarEntries(t, data)
+	for name := range testFiles {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("entry %q missing from eStargz output decompressed as a plain tar.gz", name)
+		}
+	}
+	if _, ok := entries[".prefetch.landmark"]; !ok {
+		t.Errorf("prefetch landmark missing from eStargz output")
+	}
+	if _, ok := entries["stargz.index.json"]; !ok {
+		t.Errorf("TOC entry missing from eStargz output's tar stream")
+	}
+
+	// The trailing footer must be exactly the real eStargz spec's fixed
+	// size so an eStargz-aware puller's "seek back 51 bytes" works, and
+	// its Extra field must carry the "STARGZ" magic a real puller looks
+	// for there.
+	const eStargzFooterSize = 51
+	if len(data) < eStargzFooterSize {
+		t.Fatalf("eStargz output too small to contain a footer")
+	}
+	footer := data[len(data)-eStargzFooterSize:]
+	gz, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		t.Fatalf("eStargz footer is not a valid gzip member: %v", err)
+	}
+	if _, err := io.ReadAll(gz); err != nil {
+		t.Fatalf("failed to read eStargz footer gzip member: %v", err)
+	}
+	if !bytes.HasSuffix(gz.Header.Extra, []byte("STARGZ")) {
+		t.Errorf("eStargz footer Extra field %q missing STARGZ magic", gz.Header.Extra)
+	}
+}